@@ -2,17 +2,30 @@ package idresolver
 
 import (
 	"fmt"
+	"reflect"
+	"strings"
+	"sync"
 
 	"golang.org/x/net/context"
 
 	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types/swarm"
 )
 
 // IDResolver provides ID to Name resolution.
 type IDResolver struct {
 	client    client.APIClient
 	noResolve bool
-	cache     map[string]string
+	mu        sync.Mutex
+	cache     map[cacheKey]string
+}
+
+// cacheKey is keyed by both the concrete type of the object being resolved
+// and its ID, so a node and a task that happen to share an ID never
+// collide in the cache.
+type cacheKey struct {
+	kind reflect.Type
+	id   string
 }
 
 // New creates a new IDResolver.
@@ -20,21 +33,88 @@ func New(client client.APIClient, noResolve bool) *IDResolver {
 	return &IDResolver{
 		client:    client,
 		noResolve: noResolve,
-		cache:     make(map[string]string),
+		cache:     make(map[cacheKey]string),
 	}
 }
 
 // Resolve will attempt to resolve an ID to a Name by querying the manager.
-// Results are stored into a cache.
+// Results, including lookups that found nothing, are cached so that repeated
+// calls for the same object don't re-query the API; task.Print relies on this
+// since it resolves the same service and node IDs for many tasks. Other lookup
+// errors are returned and not cached. The cache is guarded by a mutex, so
+// Resolve is safe for concurrent use.
 // If the `-n` flag is used in the command-line, resolution is disabled.
 func (r *IDResolver) Resolve(ctx context.Context, t interface{}, id string) (string, error) {
 	if r.noResolve {
 		return id, nil
 	}
-	if name, ok := r.cache[id]; ok {
+
+	key := cacheKey{kind: reflect.TypeOf(t), id: id}
+
+	r.mu.Lock()
+	name, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok {
 		return name, nil
 	}
 
-	r.cache[id] = name
+	name, err := r.lookup(ctx, t, id)
+	if err != nil {
+		if !client.IsErrNotFound(err) {
+			return "", err
+		}
+		// Cache the miss too, so a deleted node/service/task doesn't get
+		// looked up again on every subsequent reference to its ID.
+		name = id
+	}
+
+	r.mu.Lock()
+	r.cache[key] = name
+	r.mu.Unlock()
+
 	return name, nil
 }
+
+func (r *IDResolver) lookup(ctx context.Context, t interface{}, id string) (string, error) {
+	switch t.(type) {
+	case swarm.Node:
+		node, _, err := r.client.NodeInspectWithRaw(ctx, id)
+		if err != nil {
+			return "", err
+		}
+		if node.Spec.Annotations.Name != "" {
+			return node.Spec.Annotations.Name, nil
+		}
+		if node.Description.Hostname != "" {
+			return node.Description.Hostname, nil
+		}
+		return node.ID, nil
+	case swarm.Service:
+		service, _, err := r.client.ServiceInspectWithRaw(ctx, id)
+		if err != nil {
+			return "", err
+		}
+		return service.Spec.Annotations.Name, nil
+	case swarm.Task:
+		task, _, err := r.client.TaskInspectWithRaw(ctx, id)
+		if err != nil {
+			return "", err
+		}
+		serviceName, err := r.Resolve(ctx, swarm.Service{}, task.ServiceID)
+		if err != nil {
+			return "", err
+		}
+		if task.Slot != 0 {
+			return fmt.Sprintf("%s.%d", serviceName, task.Slot), nil
+		}
+		return fmt.Sprintf("%s.%s", serviceName, task.ID), nil
+	default:
+		// Non-swarm stack deploys have no nodes, services or tasks of
+		// their own; fall back to the container this ID actually names.
+		ctr, err := r.client.ContainerInspect(ctx, id)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimPrefix(ctr.Name, "/"), nil
+	}
+}
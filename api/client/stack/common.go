@@ -12,6 +12,7 @@ import (
 
 const (
 	labelNamespace = "com.docker.stack.namespace"
+	labelSpecHash  = "com.docker.stack.spec-hash"
 )
 
 func getStackLabels(namespace string, labels map[string]string) map[string]string {
@@ -37,3 +38,21 @@ func getNetworks(
 		ctx,
 		types.NetworkListOptions{Filters: getStackFilter(namespace)})
 }
+
+// getServices returns the containers that back the stack's services, i.e.
+// every container in the namespace, including stopped ones so that a
+// deploy sees them. Deploy recreates such a container only when its spec
+// hash differs from the bundle; a stopped container with an unchanged spec
+// is left stopped.
+func getServices(
+	ctx context.Context,
+	apiclient client.APIClient,
+	namespace string,
+) ([]types.Container, error) {
+	return apiclient.ContainerList(
+		ctx,
+		types.ContainerListOptions{
+			All:     true,
+			Filters: getStackFilter(namespace),
+		})
+}
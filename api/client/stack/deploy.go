@@ -3,16 +3,29 @@
 package stack
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"golang.org/x/net/context"
 
+	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/client"
 	"github.com/docker/docker/api/client/bundlefile"
 	"github.com/docker/docker/cli"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/registry"
+	apiclient "github.com/docker/engine-api/client"
 	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/container"
 	"github.com/docker/engine-api/types/network"
+	"github.com/docker/engine-api/types/strslice"
+	"github.com/docker/go-connections/nat"
 )
 
 const (
@@ -94,8 +107,9 @@ func updateNetworks(
 	}
 
 	createOpts := types.NetworkCreate{
-		Labels: getStackLabels(namespace, nil),
-		Driver: defaultNetworkDriver,
+		Labels:     getStackLabels(namespace, nil),
+		Driver:     defaultNetworkDriver,
+		Attachable: true,
 		// TODO: remove when engine-api uses omitempty for IPAM
 		IPAM: network.IPAM{Driver: "default"},
 	}
@@ -114,6 +128,16 @@ func updateNetworks(
 	return nil
 }
 
+// deployServices reconciles the services described in the bundle against
+// the containers already running in the namespace: missing services are
+// created, services whose spec changed are recreated, and services that
+// no longer appear in the bundle are deleted. An update always pulls the
+// new image, then creates its replacement container and joins it to its
+// networks before stopping and removing the one it replaces, so a failed
+// pull, create or connect leaves the previously running service in place.
+// The replacement is started only after the old container is removed and
+// the replacement renamed to take its name. Errors for individual services are
+// collected so that one bad service doesn't abort the whole deploy.
 func deployServices(
 	ctx context.Context,
 	dockerCli *client.DockerCli,
@@ -124,10 +148,237 @@ func deployServices(
 	apiClient := dockerCli.Client()
 	out := dockerCli.Out()
 
-	existingServices, err := getServices(ctx, apiClient, namespace)
+	existingContainers, err := getServices(ctx, apiClient, namespace)
 	if err != nil {
 		return err
 	}
 
+	existingByName := make(map[string]types.Container)
+	for _, ctr := range existingContainers {
+		existingByName[serviceNameFromContainer(namespace, ctr)] = ctr
+	}
+
+	var errs []string
+	for internalName, service := range services {
+		containerName := fmt.Sprintf("%s_%s", namespace, internalName)
+
+		config, hostConfig, networkingConfig, additionalNetworks, err := convertServiceToContainerConfig(namespace, service)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", containerName, err))
+			continue
+		}
+
+		existing, exists := existingByName[internalName]
+		delete(existingByName, internalName)
+
+		if exists {
+			if existing.Labels[labelSpecHash] == config.Labels[labelSpecHash] {
+				fmt.Fprintf(out, "Service %s up to date\n", containerName)
+				continue
+			}
+			fmt.Fprintf(out, "Updating service %s\n", containerName)
+		} else {
+			fmt.Fprintf(out, "Creating service %s\n", containerName)
+		}
+
+		if err := pullImage(ctx, dockerCli, service.Image, sendAuth); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", containerName, err))
+			continue
+		}
+
+		// Create (and fully wire up) the replacement container before
+		// touching the one it replaces, so a bad image or a create/connect
+		// failure leaves the previously running service untouched instead
+		// of trading a working container for none at all.
+		createName := containerName
+		if exists {
+			createName = containerName + "-new"
+			// Clean up any leftover from a previous failed update attempt.
+			_ = removeContainer(ctx, apiClient, createName)
+		}
+
+		created, err := apiClient.ContainerCreate(ctx, config, hostConfig, networkingConfig, createName)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", containerName, err))
+			continue
+		}
+
+		// The daemon only accepts a single network in NetworkingConfig at
+		// create time; attach the rest with NetworkConnect before starting
+		// the container so it comes up with every network already joined.
+		if err := connectAdditionalNetworks(ctx, apiClient, created.ID, additionalNetworks); err != nil {
+			_ = removeContainer(ctx, apiClient, created.ID)
+			errs = append(errs, fmt.Sprintf("%s: %v", containerName, err))
+			continue
+		}
+
+		if exists {
+			if err := recreateContainer(ctx, apiClient, existing.ID); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", containerName, err))
+				continue
+			}
+			if err := apiClient.ContainerRename(ctx, created.ID, containerName); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", containerName, err))
+				continue
+			}
+		}
+
+		if err := apiClient.ContainerStart(ctx, created.ID, types.ContainerStartOptions{}); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", containerName, err))
+			continue
+		}
+	}
+
+	for internalName, ctr := range existingByName {
+		containerName := fmt.Sprintf("%s_%s", namespace, internalName)
+		fmt.Fprintf(out, "Removing service %s\n", containerName)
+		if err := removeContainer(ctx, apiClient, ctr.ID); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", containerName, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("deploy failed for one or more services:\n%s", strings.Join(errs, "\n"))
+	}
 	return nil
 }
+
+// serviceNameFromContainer derives the bundlefile service name from a
+// `<namespace>_<service>` container name.
+func serviceNameFromContainer(namespace string, ctr types.Container) string {
+	prefix := namespace + "_"
+	for _, name := range ctr.Names {
+		name = strings.TrimPrefix(name, "/")
+		if strings.HasPrefix(name, prefix) {
+			return strings.TrimPrefix(name, prefix)
+		}
+	}
+	return ""
+}
+
+// convertServiceToContainerConfig translates a bundlefile service into the
+// container config/host config needed to create it, plus the networks it
+// should join. Only the first network, if any, is returned in
+// networkingConfig: the daemon rejects ContainerCreate calls whose
+// NetworkingConfig names more than one network, so the rest are returned
+// in additionalNetworks for the caller to join with NetworkConnect once
+// the container exists.
+func convertServiceToContainerConfig(
+	namespace string,
+	service bundlefile.Service,
+) (config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, additionalNetworks []string, err error) {
+	labels := getStackLabels(namespace, copyLabels(service.Labels))
+
+	exposedPorts, portBindings, err := nat.ParsePortSpecs(service.Ports)
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("invalid ports %v: %v", service.Ports, err)
+	}
+
+	config = &container.Config{
+		Image:        service.Image,
+		Cmd:          strslice.StrSlice(service.Args),
+		Entrypoint:   strslice.StrSlice(service.Command),
+		Env:          service.Env,
+		Labels:       labels,
+		ExposedPorts: exposedPorts,
+	}
+
+	hostConfig = &container.HostConfig{
+		PortBindings: portBindings,
+	}
+
+	endpointsConfig := make(map[string]*network.EndpointSettings)
+	for i, internalNetworkName := range service.Networks {
+		name := fmt.Sprintf("%s_%s", namespace, internalNetworkName)
+		if i == 0 {
+			endpointsConfig[name] = &network.EndpointSettings{}
+			continue
+		}
+		additionalNetworks = append(additionalNetworks, name)
+	}
+	networkingConfig = &network.NetworkingConfig{EndpointsConfig: endpointsConfig}
+
+	labels[labelSpecHash] = specHash(config, hostConfig, service.Networks)
+
+	return config, hostConfig, networkingConfig, additionalNetworks, nil
+}
+
+func connectAdditionalNetworks(ctx context.Context, client apiclient.APIClient, containerID string, networks []string) error {
+	for _, name := range networks {
+		if err := client.NetworkConnect(ctx, name, containerID, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+	return copied
+}
+
+// specHash returns a stable fingerprint of a service's container spec so
+// that deploy can tell whether a running container is still up to date
+// with the bundlefile. networks is passed separately from hostConfig since
+// only the first network ends up in the container's NetworkingConfig.
+func specHash(config *container.Config, hostConfig *container.HostConfig, networks []string) string {
+	buf, _ := json.Marshal(struct {
+		Config     *container.Config
+		HostConfig *container.HostConfig
+		Networks   []string
+	}{config, hostConfig, networks})
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+func recreateContainer(ctx context.Context, client apiclient.APIClient, id string) error {
+	timeout := 10 * time.Second
+	if err := client.ContainerStop(ctx, id, &timeout); err != nil {
+		return err
+	}
+	return removeContainer(ctx, client, id)
+}
+
+func removeContainer(ctx context.Context, client apiclient.APIClient, id string) error {
+	return client.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true})
+}
+
+func pullImage(ctx context.Context, dockerCli *client.DockerCli, image string, sendAuth bool) error {
+	options := types.ImagePullOptions{}
+	if sendAuth {
+		encodedAuth, err := encodedRegistryAuth(dockerCli, image)
+		if err != nil {
+			return err
+		}
+		options.RegistryAuth = encodedAuth
+	}
+
+	responseBody, err := dockerCli.Client().ImagePull(ctx, image, options)
+	if err != nil {
+		return err
+	}
+	defer responseBody.Close()
+
+	return jsonmessage.DisplayJSONMessagesStream(
+		responseBody, dockerCli.Out(), dockerCli.OutFd(), dockerCli.IsTerminalOut(), nil)
+}
+
+func encodedRegistryAuth(dockerCli *client.DockerCli, image string) (string, error) {
+	ref, err := reference.ParseNamed(image)
+	if err != nil {
+		return "", err
+	}
+	repoInfo, err := registry.ParseRepositoryInfo(ref)
+	if err != nil {
+		return "", err
+	}
+	authConfig := registry.ResolveAuthConfig(dockerCli.ConfigFile().AuthConfigs, repoInfo.Index)
+	buf, err := json.Marshal(authConfig)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(buf), nil
+}
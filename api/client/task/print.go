@@ -11,6 +11,9 @@ import (
 
 	"github.com/docker/docker/api/client"
 	"github.com/docker/docker/api/client/idresolver"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/docker/engine-api/types/swarm"
 	"github.com/docker/go-units"
 )
 
@@ -19,6 +22,15 @@ const (
 	maxErrLength  = 30
 )
 
+// acceptedPsFilters is the set of filter keys Print understands.
+var acceptedPsFilters = map[string]bool{
+	"desired-state": true,
+	"name":          true,
+	"node":          true,
+}
+
+type tasksBySlot []swarm.Task
+
 func (t tasksBySlot) Len() int {
 	return len(t)
 }
@@ -37,13 +49,82 @@ func (t tasksBySlot) Less(i, j int) bool {
 	return t[j].Meta.CreatedAt.Before(t[i].CreatedAt)
 }
 
-// Print task information in a table format
-func Print(dockerCli *client.DockerCli, ctx context.Context, resolver *idresolver.IDResolver) error {
+// Print task information in a table format.
+// Tasks are sorted by slot and filtered by the desired-state, name and
+// node predicates in filter before being written out.
+func Print(
+	ctx context.Context,
+	dockerCli *client.DockerCli,
+	tasks []swarm.Task,
+	resolver *idresolver.IDResolver,
+	noTrunc bool,
+	filter filters.Args,
+) error {
+	if err := filter.Validate(acceptedPsFilters); err != nil {
+		return err
+	}
+
+	sort.Sort(tasksBySlot(tasks))
+
 	writer := tabwriter.NewWriter(dockerCli.Out(), 0, 4, 2, ' ', 0)
 
 	// Ignore flushing errors
 	defer writer.Flush()
 	fmt.Fprintln(writer, strings.Join([]string{"ID", "NAME", "IMAGE", "NODE", "DESIRED STATE", "CURRENT STATE", "ERROR"}, "\t"))
 
+	for _, task := range tasks {
+		name, err := resolver.Resolve(ctx, task, task.ID)
+		if err != nil {
+			return err
+		}
+		nodeName, err := resolver.Resolve(ctx, swarm.Node{}, task.NodeID)
+		if err != nil {
+			return err
+		}
+
+		if !filterTask(filter, task, name, nodeName) {
+			continue
+		}
+
+		id := task.ID
+		if !noTrunc {
+			id = stringid.TruncateID(id)
+		}
+
+		taskErr := task.Status.Err
+		if !noTrunc && len(taskErr) > maxErrLength {
+			taskErr = taskErr[:maxErrLength-3] + "..."
+		}
+
+		fmt.Fprintf(
+			writer,
+			psTaskItemFmt,
+			id,
+			name,
+			task.Spec.ContainerSpec.Image,
+			nodeName,
+			task.DesiredState,
+			task.Status.State,
+			units.HumanDuration(time.Since(task.Status.Timestamp)),
+			taskErr,
+		)
+	}
+
 	return nil
 }
+
+func filterTask(filter filters.Args, task swarm.Task, name, nodeName string) bool {
+	if filter.Len() == 0 {
+		return true
+	}
+	if filter.Include("desired-state") && !filter.ExactMatch("desired-state", strings.ToLower(string(task.DesiredState))) {
+		return false
+	}
+	if filter.Include("name") && !filter.Match("name", name) {
+		return false
+	}
+	if filter.Include("node") && !filter.ExactMatch("node", nodeName) && !filter.Match("node", task.NodeID) {
+		return false
+	}
+	return true
+}
@@ -5,11 +5,12 @@ import (
 	"net"
 	"strings"
 
-	"github.com/docker/docker/errors"
 	"github.com/docker/docker/runconfig"
 	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/filters"
 	"github.com/docker/engine-api/types/network"
 	"github.com/docker/libnetwork"
+	"golang.org/x/net/context"
 )
 
 // NetworkControllerEnabled checks if the networking stack is enabled.
@@ -18,39 +19,82 @@ func (daemon *Daemon) NetworkControllerEnabled() bool {
 	return daemon.netController != nil
 }
 
-// FindNetwork function finds a network for a given string that can represent network name or id
-func (daemon *Daemon) FindNetwork(idName string) (libnetwork.Network, error) {
-	// Find by Name
-	n, err := daemon.GetNetworkByName(idName)
-	if err != nil && !isNoSuchNetworkError(err) {
-		return nil, err
-	}
+// ErrAmbiguousNetworkName is returned by FindNetwork when a term matches
+// more than one network name and no exact ID can break the tie.
+type ErrAmbiguousNetworkName struct {
+	Name       string
+	Candidates []libnetwork.Network
+}
 
-	if n != nil {
-		return n, nil
-	}
+func (e ErrAmbiguousNetworkName) Error() string {
+	return fmt.Sprintf("network %s is ambiguous (%d matches found)", e.Name, len(e.Candidates))
+}
+
+// ErrAmbiguousNetworkID is returned by FindNetwork when a term matches more
+// than one network by partial ID and no exact name can break the tie.
+type ErrAmbiguousNetworkID struct {
+	ID         string
+	Candidates []libnetwork.Network
+}
+
+func (e ErrAmbiguousNetworkID) Error() string {
+	return fmt.Sprintf("short network ID %s is ambiguous (%d matches found)", e.ID, len(e.Candidates))
+}
 
-	// Find by id
-	return daemon.GetNetworkByID(idName)
+// PredefinedNetworkError is returned when a request tries to create or
+// remove one of docker's predefined networks (bridge, host, none).
+type PredefinedNetworkError struct {
+	Name   string
+	Action string
 }
 
-func isNoSuchNetworkError(err error) bool {
-	_, ok := err.(libnetwork.ErrNoSuchNetwork)
-	return ok
+func (e PredefinedNetworkError) Error() string {
+	return fmt.Sprintf("%s is a pre-defined network and cannot be %s", e.Name, e.Action)
 }
 
-// GetNetworkByID function returns a network whose ID begins with the given prefix.
-// It fails with an error if no matching, or more than one matching, networks are found.
-func (daemon *Daemon) GetNetworkByID(partialID string) (libnetwork.Network, error) {
-	list := daemon.GetNetworksByID(partialID)
+// Forbidden lets HTTP handlers map PredefinedNetworkError to a 403 response.
+func (e PredefinedNetworkError) Forbidden() {}
+
+// FindNetwork finds a network for a given term, which may be a network name
+// or a full or partial network ID. Matching is attempted in priority order:
+// an exact full ID, an exact full name, and finally a unique partial ID
+// prefix. A term that matches more than one full name, or more than one
+// partial ID with no unique full-ID/full-name winner, is reported as
+// ErrAmbiguousNetworkName or ErrAmbiguousNetworkID, carrying the candidates.
+func (daemon *Daemon) FindNetwork(term string) (libnetwork.Network, error) {
+	listByID := daemon.GetNetworksByIDPrefix(term)
+	for _, nw := range listByID {
+		if nw.ID() == term {
+			return nw, nil
+		}
+	}
 
-	if len(list) == 0 {
-		return nil, libnetwork.ErrNoSuchNetwork(partialID)
+	all, err := daemon.GetNetworksByFilter(context.Background(), filters.NewArgs())
+	if err != nil {
+		return nil, err
 	}
-	if len(list) > 1 {
-		return nil, libnetwork.ErrInvalidID(partialID)
+
+	var byName []libnetwork.Network
+	for _, nw := range all {
+		if nw.Name() == term {
+			byName = append(byName, nw)
+		}
+	}
+	if len(byName) == 1 {
+		return byName[0], nil
 	}
-	return list[0], nil
+	if len(byName) > 1 {
+		return nil, ErrAmbiguousNetworkName{Name: term, Candidates: byName}
+	}
+
+	if len(listByID) == 1 {
+		return listByID[0], nil
+	}
+	if len(listByID) > 1 {
+		return nil, ErrAmbiguousNetworkID{ID: term, Candidates: listByID}
+	}
+
+	return nil, libnetwork.ErrNoSuchNetwork(term)
 }
 
 // GetNetworkByName function returns a network for a given network name.
@@ -65,8 +109,10 @@ func (daemon *Daemon) GetNetworkByName(name string) (libnetwork.Network, error)
 	return c.NetworkByName(name)
 }
 
-// GetNetworksByID returns a list of networks whose ID partially matches zero or more networks
-func (daemon *Daemon) GetNetworksByID(partialID string) []libnetwork.Network {
+// GetNetworksByIDPrefix returns the networks whose ID begins with the given
+// prefix. Callers that need a single unambiguous result should use
+// FindNetwork instead.
+func (daemon *Daemon) GetNetworksByIDPrefix(partialID string) []libnetwork.Network {
 	c := daemon.netController
 	if c == nil {
 		return nil
@@ -96,6 +142,78 @@ func (daemon *Daemon) getAllNetworks() []libnetwork.Network {
 	return list
 }
 
+// acceptedNetworkFilters is the set of filter keys GetNetworksByFilter understands.
+var acceptedNetworkFilters = map[string]bool{
+	"driver": true,
+	"type":   true,
+	"name":   true,
+	"id":     true,
+	"label":  true,
+	"scope":  true,
+}
+
+// GetNetworksByFilter returns every network that matches all of the
+// predicates in filter. Supported keys are name, id (exact or partial),
+// driver, scope, type=custom|builtin and label=k[=v]; an empty filter
+// matches every network. This lets callers such as `stack deploy` push
+// namespace filtering down to the daemon instead of listing everything
+// and filtering client-side.
+func (daemon *Daemon) GetNetworksByFilter(ctx context.Context, filter filters.Args) ([]libnetwork.Network, error) {
+	if err := filter.Validate(acceptedNetworkFilters); err != nil {
+		return nil, err
+	}
+
+	list := []libnetwork.Network{}
+	for _, nw := range daemon.getAllNetworks() {
+		if filter.Include("name") && !filter.ExactMatch("name", nw.Name()) {
+			continue
+		}
+		if filter.Include("id") && !matchesNetworkIDFilter(filter, nw.ID()) {
+			continue
+		}
+		if filter.Include("driver") && !filter.ExactMatch("driver", nw.Type()) {
+			continue
+		}
+		if filter.Include("scope") && !filter.ExactMatch("scope", nw.Info().Scope()) {
+			continue
+		}
+		if filter.Include("type") && !matchesNetworkTypeFilter(filter, nw) {
+			continue
+		}
+		if filter.Include("label") && !filter.MatchKVList("label", nw.Info().Labels()) {
+			continue
+		}
+		list = append(list, nw)
+	}
+	return list, nil
+}
+
+func matchesNetworkIDFilter(filter filters.Args, id string) bool {
+	for _, term := range filter.Get("id") {
+		if strings.HasPrefix(id, term) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesNetworkTypeFilter(filter filters.Args, nw libnetwork.Network) bool {
+	builtin := runconfig.IsPreDefinedNetwork(nw.Name())
+	for _, term := range filter.Get("type") {
+		switch term {
+		case "builtin":
+			if builtin {
+				return true
+			}
+		case "custom":
+			if !builtin {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // CreateNetwork creates a network with the given name, driver and other optional parameters
 func (daemon *Daemon) CreateNetwork(create types.NetworkCreateRequest) (*types.NetworkCreateResponse, error) {
 	resp, err := daemon.createNetwork(create, "", false)
@@ -107,8 +225,11 @@ func (daemon *Daemon) CreateNetwork(create types.NetworkCreateRequest) (*types.N
 
 func (daemon *Daemon) createNetwork(create types.NetworkCreateRequest, id string, agent bool) (*types.NetworkCreateResponse, error) {
 	if runconfig.IsPreDefinedNetwork(create.Name) && !agent {
-		err := fmt.Errorf("%s is a pre-defined network and cannot be created", create.Name)
-		return nil, errors.NewRequestForbiddenError(err)
+		return nil, PredefinedNetworkError{Name: create.Name, Action: "created"}
+	}
+
+	if err := validateNetworkScope(create.Scope, agent); err != nil {
+		return nil, err
 	}
 
 	var warning string
@@ -146,6 +267,21 @@ func (daemon *Daemon) createNetwork(create types.NetworkCreateRequest, id string
 	if create.Internal {
 		nwOptions = append(nwOptions, libnetwork.NetworkOptionInternalNetwork())
 	}
+	if create.Attachable {
+		nwOptions = append(nwOptions, libnetwork.NetworkOptionAttachable(create.Attachable))
+	}
+	if create.Ingress {
+		nwOptions = append(nwOptions, libnetwork.NetworkOptionIngress())
+	}
+	if create.ConfigOnly {
+		nwOptions = append(nwOptions, libnetwork.NetworkOptionConfigOnly())
+	}
+	if create.ConfigFrom != nil && create.ConfigFrom.Network != "" {
+		nwOptions = append(nwOptions, libnetwork.NetworkOptionConfigFrom(create.ConfigFrom.Network))
+	}
+	if create.Scope != "" {
+		nwOptions = append(nwOptions, libnetwork.NetworkOptionScope(create.Scope))
+	}
 	if agent {
 		nwOptions = append(nwOptions, libnetwork.NetworkOptionDynamic())
 		nwOptions = append(nwOptions, libnetwork.NetworkOptionPersist(false))
@@ -163,6 +299,25 @@ func (daemon *Daemon) createNetwork(create types.NetworkCreateRequest, id string
 	}, nil
 }
 
+// validateNetworkScope rejects any scope other than the ones libnetwork
+// understands; an empty scope defers to the driver's default. "swarm"
+// scope implies the dynamic, non-persisted network managed by the swarm
+// agent path, so it can only be requested by that path, not by a plain
+// CreateNetwork call.
+func validateNetworkScope(scope string, agent bool) error {
+	switch scope {
+	case "", "local", "global":
+		return nil
+	case "swarm":
+		if !agent {
+			return fmt.Errorf("network scope %q can only be set by the swarm agent", scope)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid network scope: %q", scope)
+	}
+}
+
 func getIpamConfig(data []network.IPAMConfig) ([]*libnetwork.IpamConf, []*libnetwork.IpamConf, error) {
 	ipamV4Cfg := []*libnetwork.IpamConf{}
 	ipamV6Cfg := []*libnetwork.IpamConf{}
@@ -172,19 +327,50 @@ func getIpamConfig(data []network.IPAMConfig) ([]*libnetwork.IpamConf, []*libnet
 		iCfg.SubPool = d.IPRange
 		iCfg.Gateway = d.Gateway
 		iCfg.AuxAddresses = d.AuxAddress
+		iCfg.Options = d.Options
 		ip, _, err := net.ParseCIDR(d.Subnet)
 		if err != nil {
 			return nil, nil, fmt.Errorf("Invalid subnet %s : %v", d.Subnet, err)
 		}
-		if ip.To4() != nil {
+		switch {
+		case ip.To4() != nil:
 			ipamV4Cfg = append(ipamV4Cfg, &iCfg)
-		} else {
+		case ip.To4() == nil && ip.To16() != nil:
 			ipamV6Cfg = append(ipamV6Cfg, &iCfg)
+		default:
+			return nil, nil, fmt.Errorf("Invalid subnet %s : unrecognized address family", d.Subnet)
 		}
 	}
+	if err := rejectOverlappingPools(ipamV4Cfg); err != nil {
+		return nil, nil, err
+	}
+	if err := rejectOverlappingPools(ipamV6Cfg); err != nil {
+		return nil, nil, err
+	}
 	return ipamV4Cfg, ipamV6Cfg, nil
 }
 
+// rejectOverlappingPools returns an error if any two pools in cfgs cover
+// overlapping address ranges.
+func rejectOverlappingPools(cfgs []*libnetwork.IpamConf) error {
+	for i, a := range cfgs {
+		_, aNet, err := net.ParseCIDR(a.PreferredPool)
+		if err != nil {
+			continue
+		}
+		for _, b := range cfgs[i+1:] {
+			_, bNet, err := net.ParseCIDR(b.PreferredPool)
+			if err != nil {
+				continue
+			}
+			if aNet.Contains(bNet.IP) || bNet.Contains(aNet.IP) {
+				return fmt.Errorf("Pools %s and %s overlap", a.PreferredPool, b.PreferredPool)
+			}
+		}
+	}
+	return nil
+}
+
 // ConnectContainerToNetwork connects the given container to the given
 // network. If either cannot be found, an err is returned. If the
 // network cannot be set up, an err is returned.
@@ -247,8 +433,7 @@ func (daemon *Daemon) deleteNetwork(networkID string, dynamic bool) error {
 	}
 
 	if runconfig.IsPreDefinedNetwork(nw.Name()) && !dynamic {
-		err := fmt.Errorf("%s is a pre-defined network and cannot be removed", nw.Name())
-		return errors.NewRequestForbiddenError(err)
+		return PredefinedNetworkError{Name: nw.Name(), Action: "removed"}
 	}
 
 	if err := nw.Delete(); err != nil {
@@ -260,5 +445,7 @@ func (daemon *Daemon) deleteNetwork(networkID string, dynamic bool) error {
 
 // GetNetworks returns a list of all networks
 func (daemon *Daemon) GetNetworks() []libnetwork.Network {
-	return daemon.getAllNetworks()
+	// An empty filter always validates and never errors.
+	list, _ := daemon.GetNetworksByFilter(context.Background(), filters.NewArgs())
+	return list
 }